@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// buildCacheFileName is where we persist the incremental-build oracle,
+// one per outDir since each outDir is a distinct platform/config.
+const buildCacheFileName = ".buildcache.json"
+
+// ObjCacheEntry is what we know about one compiled .obj the last time
+// it was built: content hashes of the source and every header
+// /showIncludes reported, plus a fingerprint of the exact command line
+// that produced it. Any mismatch forces a rebuild; a pure mtime change
+// (e.g. from `git checkout`) does not.
+type ObjCacheEntry struct {
+	SrcHash    string            `json:"srcHash"`
+	HeaderHash map[string]string `json:"headerHash"`
+	CmdFp      string            `json:"cmdFp"`
+}
+
+// BuildCache is the persisted .buildcache.json for one outDir.
+type BuildCache struct {
+	mu      sync.Mutex
+	path    string
+	Objs    map[string]*ObjCacheEntry `json:"objs"`
+	changed bool
+}
+
+func loadBuildCache(outDir string) *BuildCache {
+	bc := &BuildCache{
+		path: filepath.Join(outDir, buildCacheFileName),
+		Objs: make(map[string]*ObjCacheEntry),
+	}
+	data, err := os.ReadFile(bc.path)
+	if err != nil {
+		return bc
+	}
+	var onDisk struct {
+		Objs map[string]*ObjCacheEntry `json:"objs"`
+	}
+	if err := json.Unmarshal(data, &onDisk); err != nil {
+		// corrupt cache: treat as empty rather than failing the build
+		return bc
+	}
+	if onDisk.Objs != nil {
+		bc.Objs = onDisk.Objs
+	}
+	return bc
+}
+
+// save writes the cache back to disk. Safe to call from multiple
+// goroutines; callers should do so after all cl() calls have
+// completed (cl() itself only mutates the in-memory map).
+func (bc *BuildCache) save() {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if !bc.changed {
+		return
+	}
+	data, err := json.MarshalIndent(struct {
+		Objs map[string]*ObjCacheEntry `json:"objs"`
+	}{bc.Objs}, "", "  ")
+	if err != nil {
+		fatalf("json.MarshalIndent of build cache failed with %s\n", err)
+	}
+	if err := os.WriteFile(bc.path, data, 0644); err != nil {
+		fatalf("writing %s failed with %s\n", bc.path, err)
+	}
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cmdFingerprint hashes the exact cl.exe invocation (args + env) so
+// that changing a /D flag or switching VS versions invalidates the
+// cache even if no source touched changed.
+func cmdFingerprint(args []string, env []string) string {
+	h := sha256.New()
+	for _, a := range args {
+		io.WriteString(h, a)
+		io.WriteString(h, "\x00")
+	}
+	sortedEnv := append([]string(nil), env...)
+	sort.Strings(sortedEnv)
+	for _, e := range sortedEnv {
+		io.WriteString(h, e)
+		io.WriteString(h, "\x00")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isOutdatedCache reports whether dst needs rebuilding: true if we
+// have no prior record, the source hash changed, any previously
+// discovered header's hash changed, or the command-line/env
+// fingerprint differs. Unlike the old mtime-based isOutdated, a
+// `git checkout` that only touches mtimes is a no-op here.
+func (bc *BuildCache) isOutdatedCache(dst, src string, args []string, env []string) bool {
+	if alwaysRebuild {
+		return true
+	}
+	if !fileExists(dst) {
+		return true
+	}
+	bc.mu.Lock()
+	entry := bc.Objs[dst]
+	bc.mu.Unlock()
+	if entry == nil {
+		return true
+	}
+	srcHash, err := hashFile(src)
+	if err != nil || srcHash != entry.SrcHash {
+		return true
+	}
+	if cmdFingerprint(args, env) != entry.CmdFp {
+		return true
+	}
+	for hdr, wantHash := range entry.HeaderHash {
+		gotHash, err := hashFile(hdr)
+		if err != nil || gotHash != wantHash {
+			return true
+		}
+	}
+	fmt.Printf("%s is up to date (content cache)\n", dst)
+	return false
+}
+
+// recordCache stores the hashes that made this compile succeed, so
+// next time isOutdatedCache can tell if anything that actually matters
+// changed. headers is the list depScan extracted from /showIncludes.
+func (bc *BuildCache) recordCache(dst, src string, headers []string, args []string, env []string) {
+	entry := &ObjCacheEntry{
+		CmdFp:      cmdFingerprint(args, env),
+		HeaderHash: make(map[string]string, len(headers)),
+	}
+	if h, err := hashFile(src); err == nil {
+		entry.SrcHash = h
+	}
+	for _, hdr := range headers {
+		if h, err := hashFile(hdr); err == nil {
+			entry.HeaderHash[hdr] = h
+		}
+	}
+	bc.mu.Lock()
+	bc.Objs[dst] = entry
+	bc.changed = true
+	bc.mu.Unlock()
+}
+
+// depScan extracts the header paths cl.exe reported via /showIncludes
+// (lines of the form "Note: including file:   <path>", indentation
+// growing with include depth) out of its combined stdout/stderr. This
+// is what lets the very first build - before any cache exists -
+// populate depender information for the next one.
+func depScan(output string) []string {
+	const marker = "Note: including file:"
+	var headers []string
+	for _, line := range strings.Split(output, "\n") {
+		idx := strings.Index(line, marker)
+		if idx < 0 {
+			continue
+		}
+		path := strings.TrimSpace(line[idx+len(marker):])
+		path = strings.TrimRight(path, "\r")
+		if path != "" {
+			headers = append(headers, path)
+		}
+	}
+	return headers
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestDepScan(t *testing.T) {
+	output := "cl : Command line warning D9025\r\n" +
+		"Note: including file:  c:\\foo\\bar.h\r\n" +
+		"Note: including file:   c:\\foo\\baz.h\r\n" +
+		"foo.cpp\r\n"
+	got := depScan(output)
+	want := []string{`c:\foo\bar.h`, `c:\foo\baz.h`}
+	if len(got) != len(want) {
+		t.Fatalf("depScan(%q) = %v, want %v", output, got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("depScan(%q)[%d] = %q, want %q", output, i, got[i], want[i])
+		}
+	}
+}
+
+func TestDepScanNoIncludes(t *testing.T) {
+	got := depScan("foo.cpp\r\n")
+	if len(got) != 0 {
+		t.Errorf("depScan with no /showIncludes lines = %v, want empty", got)
+	}
+}
+
+func TestCmdFingerprintStableUnderEnvOrder(t *testing.T) {
+	args := []string{"/nologo", "/c", "foo.cpp"}
+	a := cmdFingerprint(args, []string{"B=2", "A=1"})
+	b := cmdFingerprint(args, []string{"A=1", "B=2"})
+	if a != b {
+		t.Errorf("cmdFingerprint should be independent of env order, got %q != %q", a, b)
+	}
+}
+
+func TestCmdFingerprintChangesWithArgs(t *testing.T) {
+	env := []string{"A=1"}
+	a := cmdFingerprint([]string{"/W4"}, env)
+	b := cmdFingerprint([]string{"/W3"}, env)
+	if a == b {
+		t.Errorf("cmdFingerprint should differ when args differ, both got %q", a)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BuildEvent records one tool invocation (cl.exe/rc.exe/link.exe/lib.exe)
+// for the build-log.json CI output and the end-of-run summary.
+type BuildEvent struct {
+	Tool     string        `json:"tool"`
+	Src      string        `json:"src,omitempty"`
+	Dst      string        `json:"dst,omitempty"`
+	Platform string        `json:"platform"`
+	Config   string        `json:"config"`
+	OutDir   string        `json:"-"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"durationNs"`
+	ExitCode int           `json:"exitCode"`
+	Stdout   string        `json:"stdout,omitempty"`
+	Stderr   string        `json:"stderr,omitempty"`
+}
+
+var (
+	buildEventsMu sync.Mutex
+	buildEvents   []BuildEvent
+)
+
+func recordBuildEvent(evt BuildEvent) {
+	buildEventsMu.Lock()
+	buildEvents = append(buildEvents, evt)
+	buildEventsMu.Unlock()
+}
+
+func platformLabel(platform Platform) string {
+	switch platform {
+	case Platform32Bit:
+		return "x86"
+	case Platform64Bit:
+		return "x64"
+	case PlatformARM64:
+		return "arm64"
+	case PlatformX64Native:
+		return "x64native"
+	default:
+		return "unknown"
+	}
+}
+
+func configLabel(config Config) string {
+	switch config {
+	case ConfigDebug:
+		return "debug"
+	case ConfigRelease:
+		return "release"
+	case ConfigAnalyze:
+		return "analyze"
+	default:
+		return "unknown"
+	}
+}
+
+// msvcDiagRe matches MSVC's "file(line): warning C####: text" and
+// "file(line): error C####: text" diagnostic lines.
+var msvcDiagRe = regexp.MustCompile(`(?m)^(.*?)\(\d+\)\s*:\s*(warning|error)\s+C\d+:`)
+
+// countWarningsPerFile scans a tool's combined output for MSVC
+// diagnostics and returns how many warnings were reported per file.
+func countWarningsPerFile(output string) map[string]int {
+	counts := make(map[string]int)
+	for _, m := range msvcDiagRe.FindAllStringSubmatch(output, -1) {
+		if m[2] != "warning" {
+			continue
+		}
+		counts[strings.TrimSpace(m[1])]++
+	}
+	return counts
+}
+
+// writeBuildLogs groups the events recorded this run by OutDir and
+// writes <outDir>/build-log.json (for CI dashboards) plus prints a
+// human-readable summary, slowest TU first, with a per-file warning
+// count.
+func writeBuildLogs() {
+	buildEventsMu.Lock()
+	events := append([]BuildEvent(nil), buildEvents...)
+	buildEventsMu.Unlock()
+
+	byOutDir := make(map[string][]BuildEvent)
+	for _, evt := range events {
+		byOutDir[evt.OutDir] = append(byOutDir[evt.OutDir], evt)
+	}
+
+	for outDir, evts := range byOutDir {
+		data, err := json.MarshalIndent(evts, "", "  ")
+		if err != nil {
+			fatalf("json.MarshalIndent(build-log.json) failed with %s\n", err)
+		}
+		path := pj(outDir, "build-log.json")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			fatalf("writing %s failed with %s\n", path, err)
+		}
+		printBuildSummary(outDir, evts)
+	}
+}
+
+func printBuildSummary(outDir string, evts []BuildEvent) {
+	sorted := append([]BuildEvent(nil), evts...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Duration > sorted[j].Duration
+	})
+
+	warningsByFile := make(map[string]int)
+	for _, evt := range evts {
+		for file, n := range countWarningsPerFile(evt.Stdout + evt.Stderr) {
+			warningsByFile[file] += n
+		}
+	}
+
+	fmt.Printf("\nbuild summary for %s (%d tool invocations):\n", outDir, len(sorted))
+	n := len(sorted)
+	if n > 20 {
+		n = 20
+	}
+	for i := 0; i < n; i++ {
+		evt := sorted[i]
+		name := evt.Src
+		if name == "" {
+			name = evt.Dst
+		}
+		fmt.Printf("  %8s  %-12s %s\n", evt.Duration.Round(time.Millisecond), evt.Tool, name)
+	}
+
+	if len(warningsByFile) == 0 {
+		return
+	}
+	var files []string
+	for f := range warningsByFile {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return warningsByFile[files[i]] > warningsByFile[files[j]]
+	})
+	fmt.Printf("warnings by file:\n")
+	for _, f := range files {
+		fmt.Printf("  %4d  %s\n", warningsByFile[f], f)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCountWarningsPerFile(t *testing.T) {
+	output := "src\\foo.cpp(42): warning C4100: 'x': unreferenced formal parameter\r\n" +
+		"src\\foo.cpp(57): warning C4189: 'y': local variable is initialized but not referenced\r\n" +
+		"src\\bar.cpp(10): error C2065: 'z': undeclared identifier\r\n" +
+		"src\\baz.cpp(1): warning C4800: forcing value to bool\r\n"
+	got := countWarningsPerFile(output)
+	want := map[string]int{
+		"src\\foo.cpp": 2,
+		"src\\baz.cpp": 1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("countWarningsPerFile = %v, want %v", got, want)
+	}
+}
+
+func TestCountWarningsPerFileNoDiagnostics(t *testing.T) {
+	got := countWarningsPerFile("foo.cpp\r\nCompiling...\r\n")
+	if len(got) != 0 {
+		t.Errorf("countWarningsPerFile with no diagnostics = %v, want empty", got)
+	}
+}
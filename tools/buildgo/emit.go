@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Emitter abstracts "what to do with a compile/resource/link edge".
+// execEmitter actually shells out to cl.exe/rc.exe/link.exe like this
+// tool always has; compdbEmitter and ninjaEmitter instead describe the
+// same edges for clangd/clang-tidy and ninja to consume, without
+// duplicating srcFiles/srcUtilsFiles/startArgs in a second build
+// description.
+type Emitter interface {
+	CL(src, dst string, env []string, args *Args)
+	RC(src, dst string, env []string, args *Args)
+	Link(objs []string, res string, out string, env []string, args *Args)
+}
+
+// execEmitter is the emitter used for `-emit=` unset: it runs the
+// tools for real, same as this tool always has, consulting cache to
+// skip up-to-date objects. localWg tracks just this emitter's own
+// cl.exe/rc.exe invocations (on top of the global wg every runExe call
+// joins), so Link can wait for them to finish without waiting on
+// other platforms' concurrent compiles too.
+type execEmitter struct {
+	cache    *BuildCache
+	localWg  *sync.WaitGroup
+	platform Platform
+	config   Config
+	outDir   string
+}
+
+func newExecEmitter(cache *BuildCache, platform Platform, config Config, outDir string) *execEmitter {
+	return &execEmitter{
+		cache:    cache,
+		localWg:  &sync.WaitGroup{},
+		platform: platform,
+		config:   config,
+		outDir:   outDir,
+	}
+}
+
+// evtTemplate returns a BuildEvent pre-filled with the context runExe
+// itself doesn't know (src/dst plus which platform/config/outDir this
+// emitter belongs to); runExeHelper fills in the rest.
+func (e *execEmitter) evtTemplate(src, dst string) BuildEvent {
+	return BuildEvent{
+		Src:      src,
+		Dst:      dst,
+		Platform: platformLabel(e.platform),
+		Config:   configLabel(e.config),
+		OutDir:   e.outDir,
+	}
+}
+
+func (e *execEmitter) RC(src, dst string, env []string, args *Args) {
+	createDirForFileCached(dst)
+	extraArgs := []string{
+		"/Fo" + dst,
+		src,
+	}
+	args = args.Append(extraArgs)
+	e.localWg.Add(1)
+	runExe("rc.exe", env, args, func(output string) {
+		e.localWg.Done()
+	}, e.evtTemplate(src, dst))
+}
+
+func (e *execEmitter) CL(src, dst string, env []string, args *Args) {
+	fullArgs := args.Append([]string{"/showIncludes"}).args
+	if !e.cache.isOutdatedCache(dst, src, fullArgs, env) {
+		return
+	}
+	createDirForFileCached(dst)
+	extraArgs := []string{
+		"/Fo" + dst,
+		"/showIncludes",
+		src,
+	}
+	args = args.Append(extraArgs)
+	e.localWg.Add(1)
+	runExe("cl.exe", env, args, func(output string) {
+		headers := depScan(output)
+		e.cache.recordCache(dst, src, headers, fullArgs, env)
+		e.localWg.Done()
+	}, e.evtTemplate(src, dst))
+}
+
+func (e *execEmitter) Link(objs []string, res string, out string, env []string, args *Args) {
+	e.localWg.Wait()
+	link(objs, res, out, env, args, e.evtTemplate("", out))
+}
+
+// compileCommand is one Clang compilation-database entry, per
+// https://clang.llvm.org/docs/JSONCompilationDatabase.html.
+type compileCommand struct {
+	Directory string `json:"directory"`
+	Command   string `json:"command"`
+	File      string `json:"file"`
+}
+
+// compdbEmitter records every TU seen via CL() and writes them out as
+// compile_commands.json; RC() and Link() are no-ops since Clang
+// tooling has no use for resource or link edges.
+type compdbEmitter struct {
+	cwd      string
+	commands []compileCommand
+}
+
+func newCompdbEmitter() *compdbEmitter {
+	cwd, err := os.Getwd()
+	if err != nil {
+		fatalf("os.Getwd() failed with %s\n", err)
+	}
+	return &compdbEmitter{cwd: cwd}
+}
+
+func (e *compdbEmitter) RC(src, dst string, env []string, args *Args) {}
+
+func (e *compdbEmitter) CL(src, dst string, env []string, args *Args) {
+	allArgs := append([]string{"cl.exe"}, args.Append([]string{src}).args...)
+	e.commands = append(e.commands, compileCommand{
+		Directory: e.cwd,
+		Command:   quoteCommandLine(allArgs),
+		File:      src,
+	})
+}
+
+func (e *compdbEmitter) Link(objs []string, res string, out string, env []string, args *Args) {}
+
+func (e *compdbEmitter) write(path string) {
+	data, err := json.MarshalIndent(e.commands, "", "  ")
+	if err != nil {
+		fatalf("json.MarshalIndent(compile_commands.json) failed with %s\n", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		fatalf("writing %s failed with %s\n", path, err)
+	}
+	fmt.Printf("wrote %s with %d entries\n", path, len(e.commands))
+}
+
+// ninjaEmitter records cl/rc/link edges and writes them out as a
+// build.ninja that reuses cl.exe's own /showIncludes output for
+// dependency info (deps = msvc), same as CMake's Ninja generator does
+// for MSVC.
+type ninjaEmitter struct {
+	rules []string
+}
+
+func ninjaEscape(s string) string {
+	s = strings.ReplaceAll(s, "$", "$$")
+	s = strings.ReplaceAll(s, ":", "$:")
+	s = strings.ReplaceAll(s, " ", "$ ")
+	return s
+}
+
+func (e *ninjaEmitter) RC(src, dst string, env []string, args *Args) {
+	cmd := quoteCommandLine(append([]string{"rc.exe"}, args.Append([]string{"/Fo" + dst, src}).args...))
+	e.rules = append(e.rules, fmt.Sprintf(
+		"build %s: rc %s\n  command = %s\n", ninjaEscape(dst), ninjaEscape(src), cmd))
+}
+
+func (e *ninjaEmitter) CL(src, dst string, env []string, args *Args) {
+	cmd := quoteCommandLine(append([]string{"cl.exe"}, args.Append([]string{"/showIncludes", "/Fo" + dst, src}).args...))
+	e.rules = append(e.rules, fmt.Sprintf(
+		"build %s: cl %s\n  command = %s\n", ninjaEscape(dst), ninjaEscape(src), cmd))
+}
+
+func (e *ninjaEmitter) Link(objs []string, res string, out string, env []string, args *Args) {
+	var escaped []string
+	for _, o := range objs {
+		escaped = append(escaped, ninjaEscape(o))
+	}
+	in := strings.Join(escaped, " ")
+	if res != "" {
+		in += " " + ninjaEscape(res)
+	}
+	cmd := quoteCommandLine(append([]string{"link.exe"}, args.Append(append(append([]string{}, objs...), res, "/OUT:"+out)).args...))
+	e.rules = append(e.rules, fmt.Sprintf(
+		"build %s: link %s\n  command = %s\n", ninjaEscape(out), in, cmd))
+}
+
+func (e *ninjaEmitter) write(path string) {
+	var sb strings.Builder
+	// deps = msvc has ninja parse /showIncludes lines straight from the
+	// command's own stdout; there's no depfile to point it at.
+	sb.WriteString("rule cl\n  command = $command\n  deps = msvc\n\n")
+	sb.WriteString("rule rc\n  command = $command\n\n")
+	sb.WriteString("rule link\n  command = $command\n\n")
+	for _, rule := range e.rules {
+		sb.WriteString(rule)
+		sb.WriteString("\n")
+	}
+	if err := os.WriteFile(path, []byte(sb.String()), 0644); err != nil {
+		fatalf("writing %s failed with %s\n", path, err)
+	}
+	fmt.Printf("wrote %s with %d edges\n", path, len(e.rules))
+}
+
+// quoteCommandLine joins args the way cmd.exe/MSVC expects: wrap any
+// argument containing a space in double quotes.
+func quoteCommandLine(args []string) string {
+	var parts []string
+	for _, a := range args {
+		if strings.ContainsAny(a, " \t") {
+			parts = append(parts, `"`+a+`"`)
+		} else {
+			parts = append(parts, a)
+		}
+	}
+	return strings.Join(parts, " ")
+}
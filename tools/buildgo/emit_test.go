@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestQuoteCommandLine(t *testing.T) {
+	got := quoteCommandLine([]string{"cl.exe", "/Fo" + "out.obj", "c:\\some path\\foo.cpp"})
+	want := `cl.exe /Foout.obj "c:\some path\foo.cpp"`
+	if got != want {
+		t.Errorf("quoteCommandLine = %q, want %q", got, want)
+	}
+}
+
+func TestNinjaEscape(t *testing.T) {
+	cases := map[string]string{
+		"foo.obj":     "foo.obj",
+		"foo bar.obj": `foo$ bar.obj`,
+		"c:\\a:b":     `c$:\a$:b`,
+		"$weird$name": `$$weird$$name`,
+	}
+	for in, want := range cases {
+		if got := ninjaEscape(in); got != want {
+			t.Errorf("ninjaEscape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"path/filepath"
+)
+
+// link invokes link.exe to produce out (an .exe or .dll) from objs
+// (object files and, optionally, static libs) plus the resource file
+// res (empty if there isn't one). evt is the caller's BuildEvent
+// template (src/dst/platform/config/outDir) for the build log.
+func link(objs []string, res string, out string, env []string, args *Args, evt BuildEvent) {
+	createDirForFileCached(out)
+	extraArgs := append([]string{}, objs...)
+	if res != "" {
+		extraArgs = append(extraArgs, res)
+	}
+	extraArgs = append(extraArgs, "/OUT:"+out)
+	args = args.Append(extraArgs)
+	runExe("link.exe", envForLink(env), args, nil, evt)
+}
+
+// lib invokes lib.exe to archive objs into a static library out.lib.
+// Used to build the muPDF/zlib/unarr dependencies that live under
+// ext/ into .lib files the final link() pulls in. evt is the caller's
+// BuildEvent template for the build log.
+func lib(objs []string, out string, env []string, args *Args, evt BuildEvent) {
+	createDirForFileCached(out)
+	extraArgs := append([]string{}, objs...)
+	extraArgs = append(extraArgs, "/OUT:"+out)
+	args = args.Append(extraArgs)
+	runExe("lib.exe", env, args, nil, evt)
+}
+
+// linkArgsFor returns the flags common to every SumatraPDF link step:
+// a release-quality executable with a PDB, dead code stripped, and its
+// manifest embedded rather than shipped as a side-by-side .manifest.
+func linkArgsFor(outDir, baseName string) *Args {
+	return &Args{args: []string{
+		"/nologo",
+		"/SUBSYSTEM:WINDOWS",
+		"/DEBUG",
+		"/OPT:REF,ICF",
+		"/MANIFEST:EMBED",
+		"/PDB:" + pj(outDir, baseName+".pdb"),
+		"/MAP:" + pj(outDir, baseName+".map"),
+	}}
+}
+
+// envForLink prepends the host toolset's own bin dir to PATH so
+// link.exe (running under a cross host/target combo, e.g.
+// x86_arm64) can still find its own mspdbcore.dll - vcvarsall.bat
+// already does this for cl.exe's host, but a second host dir can be
+// needed for the linker under some cross combos.
+func envForLink(env []string) []string {
+	inst := pickVSInstall()
+	if inst == nil {
+		return env
+	}
+	hostDir := bestHostBinDir(inst)
+	if hostDir == "" {
+		return env
+	}
+	return prependPath(env, hostDir)
+}
+
+// bestHostBinDir returns the Host<arch> bin dir for the native
+// architecture of the machine running this script, preferring x64.
+func bestHostBinDir(inst *VSInstall) string {
+	for _, host := range []string{"Hostx64", "Hostx86"} {
+		matches, _ := filepath.Glob(pj(inst.VCToolsDir, "bin", host, host[4:]))
+		if len(matches) > 0 {
+			return matches[0]
+		}
+	}
+	return ""
+}
+
+func prependPath(env []string, dir string) []string {
+	res := make([]string, 0, len(env))
+	found := false
+	for _, e := range env {
+		if len(e) >= 5 && (e[:5] == "PATH=" || e[:5] == "Path=" || e[:5] == "path=") {
+			res = append(res, e[:5]+dir+string(filepath.ListSeparator)+e[5:])
+			found = true
+			continue
+		}
+		res = append(res, e)
+	}
+	if !found {
+		res = append(res, "PATH="+dir)
+	}
+	return res
+}
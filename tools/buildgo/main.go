@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
 	"os"
 	"os/exec"
@@ -45,8 +47,10 @@ type Platform int
 type Config int
 
 const (
-	Platform32Bit Platform = 1
-	Platform64Bit Platform = 2
+	Platform32Bit     Platform = 1
+	Platform64Bit     Platform = 2
+	PlatformARM64     Platform = 3
+	PlatformX64Native Platform = 4
 
 	ConfigDebug   Config = 1
 	ConfigRelease Config = 2
@@ -54,11 +58,34 @@ const (
 )
 
 var (
-	alwaysRebuild bool = false
-	wg            sync.WaitGroup
-	sem           chan bool
+	alwaysRebuild    bool = false
+	cleanCache       bool = false
+	warningsAsErrors bool = true
+	wg               sync.WaitGroup
+	sem              chan bool
+
+	buildCachesMu sync.Mutex
+	buildCaches   []*BuildCache
 )
 
+// registerBuildCache makes cache visible to saveBuildCaches, which is
+// called once all compiles have finished (cl() only updates caches
+// in-memory; writing them out earlier would race with in-flight
+// compiles).
+func registerBuildCache(cache *BuildCache) {
+	buildCachesMu.Lock()
+	buildCaches = append(buildCaches, cache)
+	buildCachesMu.Unlock()
+}
+
+func saveBuildCaches() {
+	buildCachesMu.Lock()
+	defer buildCachesMu.Unlock()
+	for _, cache := range buildCaches {
+		cache.save()
+	}
+}
+
 // maps upper-cased name of env variable to Name/Val
 func envToMap(env []string) map[string]*EnvVar {
 	res := make(map[string]*EnvVar)
@@ -115,22 +142,15 @@ func calcEnvAdded(before, after map[string]*EnvVar) map[string]*EnvVar {
 	return res
 }
 
-var (
-	cachedVcInstallDir string
-)
-
-// return value of VCINSTALLDIR env variable after running vsvars32.bat
-func getVcInstallDir(toolsDir string) string {
-	if cachedVcInstallDir == "" {
-		env := getEnvAfterScript(toolsDir, "vsvars32.bat")
-		val := env["VCINSTALLDIR"]
-		if val == nil {
-			fmt.Printf("no 'VCINSTALLDIR' variable in %s\n", env)
-			os.Exit(1)
-		}
-		cachedVcInstallDir = val.Val
+// vcVarsAllDir returns the directory containing vcvarsall.bat for the
+// given VS install: VS2017+ moved it to VC\Auxiliary\Build, VS7-VS14
+// keep it directly under VC.
+func vcVarsAllDir(inst *VSInstall) string {
+	modern := pj(inst.InstallDir, "VC", "Auxiliary", "Build")
+	if fileExists(pj(modern, "vcvarsall.bat")) {
+		return modern
 	}
-	return cachedVcInstallDir
+	return inst.VCToolsDir
 }
 
 func getEnvForVcTools(vcInstallDir, platform string) []string {
@@ -154,6 +174,32 @@ func getEnv64(vcInstallDir string) []string {
 	return getEnvForVcTools(vcInstallDir, "x86_amd64")
 }
 
+// getEnvArm64 cross-compiles ARM64 binaries. amd64_arm64 uses the
+// 64-bit host compiler and is preferred since it can address more
+// memory while compiling; x86_arm64 is the fallback every VC install
+// ships, for machines without 64-bit host tools installed.
+func getEnvArm64(vcInstallDir string) []string {
+	if hostToolsExist(vcInstallDir, "Hostx64") {
+		return getEnvForVcTools(vcInstallDir, "amd64_arm64")
+	}
+	return getEnvForVcTools(vcInstallDir, "x86_arm64")
+}
+
+// getEnvX64Native uses the 64-bit host compiler to build 64-bit
+// binaries natively, instead of the x86_amd64 cross compiler getEnv64
+// uses.
+func getEnvX64Native(vcInstallDir string) []string {
+	return getEnvForVcTools(vcInstallDir, "amd64")
+}
+
+// hostToolsExist reports whether vcInstallDir has a 64-bit host
+// toolset (HostX64) available, which vcvarsall.bat needs to honor an
+// "amd64_*" host/target combo.
+func hostToolsExist(vcInstallDir, hostDirName string) bool {
+	matches, _ := filepath.Glob(pj(vcInstallDir, "Tools", "MSVC", "*", "bin", hostDirName))
+	return len(matches) > 0
+}
+
 func dumpEnv(env map[string]*EnvVar) {
 	var keys []string
 	for k := range env {
@@ -167,28 +213,39 @@ func dumpEnv(env map[string]*EnvVar) {
 }
 
 func getEnv(platform Platform) []string {
-	initialEnv := envToMap(os.Environ())
-	vs2013 := initialEnv["VS120COMNTOOLS"]
-	vs2015 := initialEnv["VS140COMNTOOLS"]
-	vsVar := vs2015
-	if vsVar == nil {
-		vsVar = vs2013
-	}
-	if vsVar == nil {
-		fmt.Printf("VS120COMNTOOLS or VS140COMNTOOLS not set; VS 2013 or 2015 not installed\n")
-		os.Exit(1)
+	inst := pickVSInstall()
+	if inst == nil {
+		if vsVersionFlag != "" {
+			fatalf("no Visual Studio %s installation with VC++ tools found\n", vsVersionFlag)
+		}
+		fatalf("no Visual Studio installation with VC++ tools found\n")
 	}
-	vcInstallDir := getVcInstallDir(vsVar.Val)
+	vcInstallDir := vcVarsAllDir(inst)
 	switch platform {
 	case Platform32Bit:
 		return getEnv32(vcInstallDir)
 	case Platform64Bit:
 		return getEnv64(vcInstallDir)
+	case PlatformARM64:
+		return getEnvArm64(vcInstallDir)
+	case PlatformX64Native:
+		return getEnvX64Native(vcInstallDir)
 	default:
 		panic("unknown platform")
 	}
 }
 
+// archArgsFor returns the /arch: flag for cl.exe, if any. /arch:IA32
+// only means anything for the 32-bit compiler; 64-bit and ARM64
+// targets use their platform default (which is at least as good) and
+// would error out on an IA32 value.
+func archArgsFor(platform Platform) []string {
+	if platform == Platform32Bit {
+		return []string{"/arch:IA32"}
+	}
+	return nil
+}
+
 func getOutDir(platform Platform, config Config) string {
 	dir := ""
 	switch config {
@@ -197,8 +254,11 @@ func getOutDir(platform Platform, config Config) string {
 	case ConfigDebug:
 		dir = "dbg"
 	}
-	if platform == Platform64Bit {
+	switch platform {
+	case Platform64Bit, PlatformX64Native:
 		dir += "64"
+	case PlatformARM64:
+		dir += "arm64"
 	}
 	return dir
 }
@@ -225,6 +285,10 @@ func (a *Args) Append(toAppend []string) *Args {
 }
 
 var (
+	// cacheMu guards cachedExePaths/createdDirs/fileInfoCache: build()
+	// fans platforms out across goroutines (see -platform), and they all
+	// share these caches.
+	cacheMu        sync.Mutex
 	cachedExePaths map[string]string
 	createdDirs    map[string]bool
 	fileInfoCache  map[string]os.FileInfo
@@ -237,19 +301,27 @@ func init() {
 }
 
 func fileExists(path string) bool {
-	if _, ok := fileInfoCache[path]; !ok {
-		fi, err := os.Stat(path)
+	cacheMu.Lock()
+	fi, ok := fileInfoCache[path]
+	cacheMu.Unlock()
+	if !ok {
+		statFi, err := os.Stat(path)
 		if err != nil {
 			return false
 		}
-		fileInfoCache[path] = fi
+		cacheMu.Lock()
+		fileInfoCache[path] = statFi
+		cacheMu.Unlock()
+		fi = statFi
 	}
-	fi := fileInfoCache[path]
 	return fi.Mode().IsRegular()
 }
 
 func createDirCached(dir string) {
-	if _, ok := createdDirs[dir]; ok {
+	cacheMu.Lock()
+	_, ok := createdDirs[dir]
+	cacheMu.Unlock()
+	if ok {
 		return
 	}
 	if err := os.MkdirAll(dir, 0644); err != nil {
@@ -257,43 +329,6 @@ func createDirCached(dir string) {
 	}
 }
 
-func getModTime(path string, def time.Time) time.Time {
-	if _, ok := fileInfoCache[path]; !ok {
-		fi, err := os.Stat(path)
-		if err != nil {
-			return def
-		}
-		fileInfoCache[path] = fi
-	}
-	fi := fileInfoCache[path]
-	return fi.ModTime()
-}
-
-// returns true if dst doesn't exist or is older than src or any of the deps
-func isOutdated(src, dst string, deps []string) bool {
-	if alwaysRebuild {
-		return true
-	}
-	if !fileExists(dst) {
-		return true
-	}
-	dstTime := getModTime(dst, time.Now())
-	srcTime := getModTime(src, time.Now())
-	if srcTime.Sub(dstTime) > 0 {
-		return true
-	}
-	for _, path := range deps {
-		pathTime := getModTime(path, time.Now())
-		if srcTime.Sub(pathTime) > 0 {
-			return true
-		}
-	}
-	if true {
-		fmt.Printf("%s is up to date\n", dst)
-	}
-	return false
-}
-
 func createDirForFileCached(path string) {
 	createDirCached(filepath.Dir(path))
 }
@@ -318,62 +353,72 @@ func lookupInEnvPathUncached(exeName string, env []string) string {
 }
 
 func lookupInEnvPath(exeName string, env []string) string {
-	if _, ok := cachedExePaths[exeName]; !ok {
-		cachedExePaths[exeName] = lookupInEnvPathUncached(exeName, env)
-		fmt.Printf("found %s as %s\n", exeName, cachedExePaths[exeName])
-	}
-	return cachedExePaths[exeName]
-}
-
-func runExeHelper(exeName string, env []string, args *Args) {
+	cacheMu.Lock()
+	path, ok := cachedExePaths[exeName]
+	cacheMu.Unlock()
+	if ok {
+		return path
+	}
+	path = lookupInEnvPathUncached(exeName, env)
+	cacheMu.Lock()
+	cachedExePaths[exeName] = path
+	cacheMu.Unlock()
+	fmt.Printf("found %s as %s\n", exeName, path)
+	return path
+}
+
+// runExeHelper runs exeName to completion and, on success, hands its
+// combined output to onDone (if non-nil) before the goroutine that
+// invoked it is allowed to exit. Used by cl() to feed /showIncludes
+// output back into the build cache.
+// runExeHelper runs exeName to completion, records a BuildEvent (evt
+// carries the Tool/Src/Dst/Platform/Config/OutDir the caller already
+// knows) and, on success, hands the combined output to onDone.
+func runExeHelper(exeName string, env []string, args *Args, onDone func(output string), evt BuildEvent) {
 	exePath := lookupInEnvPath(exeName, env)
 	cmd := exec.Command(exePath, args.args...)
 	cmd.Env = env
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
 	if true {
 		args := cmd.Args
 		args[0] = exeName
 		fmt.Printf("Running %s\n", args)
 		args[0] = exePath
 	}
-	out, err := cmd.CombinedOutput()
+	evt.Tool = exeName
+	evt.Start = time.Now()
+	err := cmd.Run()
+	evt.Duration = time.Since(evt.Start)
+	evt.Stdout = stdout.String()
+	evt.Stderr = stderr.String()
 	if err != nil {
-		fatalf("%s failed with %s, out:\n%s\n", cmd.Args, err, string(out))
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			evt.ExitCode = exitErr.ExitCode()
+		} else {
+			evt.ExitCode = -1
+		}
+	}
+	recordBuildEvent(evt)
+	if err != nil {
+		fatalf("%s failed with %s, out:\n%s%s\n", cmd.Args, err, evt.Stdout, evt.Stderr)
+	}
+	if onDone != nil {
+		onDone(evt.Stdout + evt.Stderr)
 	}
 }
 
-func runExe(exeName string, env []string, args *Args) {
+func runExe(exeName string, env []string, args *Args, onDone func(output string), evt BuildEvent) {
 	semEnter()
 	wg.Add(1)
 	go func() {
-		runExeHelper(exeName, env, args)
+		runExeHelper(exeName, env, args, onDone, evt)
 		semLeave()
 		wg.Done()
 	}()
 }
 
-func rc(src, dst string, env []string, args *Args) {
-	createDirForFileCached(dst)
-	extraArgs := []string{
-		"/Fo" + dst,
-		src,
-	}
-	args = args.Append(extraArgs)
-	runExe("rc.exe", env, args)
-}
-
-func cl(src, dst string, env []string, args *Args) {
-	if !isOutdated(src, dst, nil) {
-		return
-	}
-	createDirForFileCached(dst)
-	extraArgs := []string{
-		"/Fo" + dst,
-		src,
-	}
-	args = args.Append(extraArgs)
-	runExe("cl.exe", env, args)
-}
-
 func fatalf(format string, args ...interface{}) {
 	fmt.Printf(format, args...)
 	os.Exit(1)
@@ -416,21 +461,94 @@ func clOut(src, outDir string) string {
 	return replaceExt(s, ".obj")
 }
 
-func clDir(srcDir string, files []string, outDir string, env []string, args *Args) {
+// clDir compiles every file in srcDir and returns the resulting .obj
+// paths, so callers can hand the full object list to Link().
+// zlibFiles is ext/zlib's own upstream source list; unarr and muPDF
+// aren't enumerated here yet (see the "if false" block in buildOne).
+var zlibFiles = []string{
+	"adler32.c",
+	"compress.c",
+	"crc32.c",
+	"deflate.c",
+	"gzclose.c",
+	"gzlib.c",
+	"gzread.c",
+	"gzwrite.c",
+	"infback.c",
+	"inffast.c",
+	"inflate.c",
+	"inftrees.c",
+	"trees.c",
+	"uncompr.c",
+	"zutil.c",
+}
+
+func clDir(srcDir string, files []string, outDir string, env []string, args *Args, emitter Emitter) []string {
+	objs := make([]string, 0, len(files))
 	for _, f := range files {
 		src := filepath.Join(srcDir, f)
 		dst := clOut(src, outDir)
-		cl(src, dst, env, args)
+		emitter.CL(src, dst, env, args)
+		objs = append(objs, dst)
 	}
+	return objs
 }
 
 func pj(elem ...string) string {
 	return filepath.Join(elem...)
 }
 
-func build(platform Platform, config Config) {
-	env := getEnv(platform)
-	//dumpEnv(env)
+// parsePlatforms turns a comma-separated -platform value (using the same
+// names buildlog.go's platformLabel prints, e.g. "x86,x64,arm64") into
+// the Platform list build() should fan out across.
+func parsePlatforms(s string) []Platform {
+	var res []Platform
+	for _, name := range strings.Split(s, ",") {
+		switch strings.TrimSpace(name) {
+		case "x86":
+			res = append(res, Platform32Bit)
+		case "x64":
+			res = append(res, Platform64Bit)
+		case "arm64":
+			res = append(res, PlatformARM64)
+		case "x64native":
+			res = append(res, PlatformX64Native)
+		default:
+			fatalf("unknown -platform value %q, want any of x86,x64,arm64,x64native\n", name)
+		}
+	}
+	return res
+}
+
+// build fans a config out across platforms concurrently: each
+// platform's cl/rc invocations still go through the shared wg/sem pool,
+// so this just lets their (synchronous) getEnv() calls overlap too.
+func build(platforms []Platform, config Config) {
+	var platformWg sync.WaitGroup
+	for _, platform := range platforms {
+		platform := platform
+		platformWg.Add(1)
+		go func() {
+			defer platformWg.Done()
+			outDir := getOutDir(platform, config)
+			createDirCached(outDir)
+			if cleanCache {
+				os.Remove(filepath.Join(outDir, buildCacheFileName))
+			}
+			cache := loadBuildCache(outDir)
+			registerBuildCache(cache)
+			buildOne(platform, config, getEnv(platform), newExecEmitter(cache, platform, config, outDir))
+		}()
+	}
+	platformWg.Wait()
+}
+
+// buildOne walks the same source lists and startArgs regardless of
+// emitter: execEmitter actually runs cl.exe/rc.exe, while
+// compdbEmitter/ninjaEmitter just record the edges for -emit=compdb
+// and -emit=ninja. env may be nil for those, since they never launch a
+// process and so never need to resolve cl.exe/rc.exe via PATH.
+func buildOne(platform Platform, config Config, env []string, emitter Emitter) {
 	outDir := getOutDir(platform, config)
 	createDirCached(outDir)
 
@@ -441,7 +559,7 @@ func build(platform Platform, config Config) {
 	}
 	rcSrc := filepath.Join("src", "SumatraPDF.rc")
 	rcDst := rcOut(rcSrc, outDir)
-	rc(rcSrc, rcDst, env, &Args{args: rcArgs})
+	emitter.RC(rcSrc, rcDst, env, &Args{args: rcArgs})
 
 	startArgs := []string{
 		"/nologo", "/c",
@@ -457,13 +575,11 @@ func build(platform Platform, config Config) {
 		"/GS",
 		"/Gy",
 		"/GF",
-		"/arch:IA32",
 		"/EHs-c-",
 		"/MTd",
 		"/Od",
 		"/RTCs",
 		"/RTCu",
-		"/WX",
 		"/W4",
 		"/FS",
 		"/wd4100",
@@ -489,6 +605,10 @@ func build(platform Platform, config Config) {
 		//fmt.Sprintf("/Fo%s\\sumatrapdf", outDir),
 		fmt.Sprintf("/Fd%s\\vc80.pdb", outDir),
 	}
+	startArgs = append(startArgs, archArgsFor(platform)...)
+	if warningsAsErrors {
+		startArgs = append(startArgs, "/WX")
+	}
 	initialClArgs := &Args{
 		args: startArgs,
 	}
@@ -534,13 +654,13 @@ func build(platform Platform, config Config) {
 		"Canvas.cpp",
 		"TabInfo.cpp",
 	}
-	clDir("src", srcFiles, outDir, env, initialClArgs)
+	objs := clDir("src", srcFiles, outDir, env, initialClArgs, emitter)
 
 	if false {
 		regressFiles := []string{
 			"Regress.cpp",
 		}
-		clDir(pj("src", "regress"), regressFiles, outDir, env, initialClArgs)
+		clDir(pj("src", "regress"), regressFiles, outDir, env, initialClArgs, emitter)
 	}
 
 	srcUtilsFiles := []string{
@@ -584,7 +704,35 @@ func build(platform Platform, config Config) {
 		"LzmaSimpleArchive.cpp",
 		"Dpi.cpp",
 	}
-	clDir(pj("src", "utils"), srcUtilsFiles, outDir, env, initialClArgs)
+	objs = append(objs, clDir(pj("src", "utils"), srcUtilsFiles, outDir, env, initialClArgs, emitter)...)
+
+	zlibObjs := clDir(pj("ext", "zlib"), zlibFiles, outDir, env, initialClArgs, emitter)
+	if ee, ok := emitter.(*execEmitter); ok {
+		// pack into a .lib the same way the muPDF/unarr static deps
+		// would be, once their own source lists are wired up here too.
+		ee.localWg.Wait()
+		zlibLib := pj(outDir, "zlib.lib")
+		lib(zlibObjs, zlibLib, env, &Args{args: []string{"/nologo"}}, ee.evtTemplate("", zlibLib))
+		objs = append(objs, zlibLib)
+	} else {
+		objs = append(objs, zlibObjs...)
+	}
+
+	exeOut := pj(outDir, "SumatraPDF.exe")
+	emitter.Link(objs, rcDst, exeOut, env, linkArgsFor(outDir, "SumatraPDF"))
+
+	// TODO(chunk0-5): SumatraPDF-dll.exe / libmupdf.dll is NOT built by
+	// this script. The split-DLL variant needs its own thin launcher
+	// object and a mupdf.lib built from mupdf/, neither of which this
+	// script compiles (mupdf/unarr aren't wired into buildOne at all);
+	// the edge below is left disabled (like the Regress.cpp block above)
+	// rather than faked with the wrong inputs. Only SumatraPDF.exe is a
+	// real, working link target today - treat the dll variant as an open
+	// follow-up, not a shipped part of the link stage.
+	if false {
+		dllOut := pj(outDir, "SumatraPDF-dll.exe")
+		emitter.Link(objs, rcDst, dllOut, env, linkArgsFor(outDir, "SumatraPDF-dll"))
+	}
 }
 
 func semEnter() {
@@ -596,11 +744,39 @@ func semLeave() {
 }
 
 func main() {
+	var emitMode string
+	var platformsFlag string
+	flag.StringVar(&vsVersionFlag, "vs-version", "", "pin a specific major Visual Studio version (e.g. \"14\", \"16\") instead of using the highest one found")
+	flag.BoolVar(&cleanCache, "clean-cache", false, "discard the on-disk incremental-build cache and rebuild everything")
+	flag.StringVar(&platformsFlag, "platform", "x86", "comma-separated platforms to build: x86,x64,arm64,x64native")
+	flag.StringVar(&emitMode, "emit", "", "instead of building, write a build graph: \"compdb\" for compile_commands.json, \"ninja\" for build.ninja")
+	flag.BoolVar(&warningsAsErrors, "warnings-as-errors", true, "pass /WX so compiler warnings fail the build")
+	flag.Parse()
+
+	switch emitMode {
+	case "":
+		// fall through to the real build below
+	case "compdb":
+		e := newCompdbEmitter()
+		buildOne(Platform32Bit, ConfigRelease, nil, e)
+		e.write("compile_commands.json")
+		return
+	case "ninja":
+		e := &ninjaEmitter{}
+		buildOne(Platform32Bit, ConfigRelease, nil, e)
+		e.write("build.ninja")
+		return
+	default:
+		fatalf("unknown -emit value %q, want \"compdb\" or \"ninja\"\n", emitMode)
+	}
+
 	n := runtime.NumCPU()
 	fmt.Printf("Using %d goroutines\n", n)
 	sem = make(chan bool, n)
 	timeStart := time.Now()
-	build(Platform32Bit, ConfigRelease)
+	build(parsePlatforms(platformsFlag), ConfigRelease)
 	wg.Wait()
+	saveBuildCaches()
+	writeBuildLogs()
 	fmt.Printf("total time: %s\n", time.Since(timeStart))
 }
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentCacheAccess exercises fileExists/createDirCached the way
+// build()'s per-platform goroutines do (one -platform entry each); run
+// with -race to catch a regression of the concurrent map read/write this
+// guarded against.
+func TestConcurrentCacheAccess(t *testing.T) {
+	dir := t.TempDir()
+	f := filepath.Join(dir, "exists.txt")
+	if err := os.WriteFile(f, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fileExists(f)
+			createDirCached(filepath.Join(dir, "sub", string(rune('a'+i))))
+		}()
+	}
+	wg.Wait()
+}
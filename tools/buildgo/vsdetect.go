@@ -0,0 +1,375 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// A VSInstall describes a single Visual Studio installation that has the
+// C++ build tools we need.
+type VSInstall struct {
+	Version    string // e.g. "14.0", "15.0", "16.11.31829.152"
+	InstallDir string // e.g. "C:\Program Files (x86)\Microsoft Visual Studio 14.0"
+	VCToolsDir string // e.g. "C:\...\VC" or "C:\...\VC\Tools\MSVC\14.28.29910"
+}
+
+// pinned via -vs-version, empty means "pick the highest"
+var vsVersionFlag string
+
+// registry keys we probe for legacy (VS7 - VS14) installs.
+// Note: 32-bit installer always writes under the 32-bit view of the
+// registry, even on 64-bit Windows, so we must open it with
+// KEY_WOW64_32KEY.
+const vs7RegPath = `SOFTWARE\Microsoft\VisualStudio\SxS\VS7`
+
+// findVSInstallsLegacy reads SOFTWARE\Microsoft\VisualStudio\SxS\VS7,
+// which maps version number ("14.0", "12.0" etc.) to install dir, for
+// VS versions that pre-date the 2017 "willow" installer.
+func findVSInstallsLegacy() []VSInstall {
+	var res []VSInstall
+	res = append(res, readVS7Key(syscall.KEY_READ)...)
+	res = append(res, readVS7Key(syscall.KEY_READ|syscall.KEY_WOW64_32KEY)...)
+	return res
+}
+
+func readVS7Key(access uint32) []VSInstall {
+	var key syscall.Handle
+	pathPtr, err := syscall.UTF16PtrFromString(vs7RegPath)
+	if err != nil {
+		return nil
+	}
+	err = syscall.RegOpenKeyEx(syscall.HKEY_LOCAL_MACHINE, pathPtr, 0, access, &key)
+	if err != nil {
+		return nil
+	}
+	defer syscall.RegCloseKey(key)
+
+	var res []VSInstall
+	for idx := uint32(0); ; idx++ {
+		nameBuf := make([]uint16, 64)
+		nameLen := uint32(len(nameBuf))
+		err := syscall.RegEnumKeyEx(key, idx, &nameBuf[0], &nameLen, nil, nil, nil, nil)
+		if err != nil {
+			break
+		}
+		version := syscall.UTF16ToString(nameBuf[:nameLen])
+		dir, ok := regQueryStringValue(key, version)
+		if !ok || dir == "" {
+			continue
+		}
+		res = append(res, VSInstall{
+			Version:    version,
+			InstallDir: dir,
+			VCToolsDir: pj(dir, "VC"),
+		})
+	}
+	return res
+}
+
+func regQueryStringValue(key syscall.Handle, name string) (string, bool) {
+	namePtr, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return "", false
+	}
+	var typ uint32
+	var bufLen uint32
+	err = syscall.RegQueryValueEx(key, namePtr, nil, &typ, nil, &bufLen)
+	if err != nil || bufLen == 0 {
+		return "", false
+	}
+	buf := make([]uint16, bufLen/2+1)
+	err = syscall.RegQueryValueEx(key, namePtr, nil, &typ, (*byte)(unsafe.Pointer(&buf[0])), &bufLen)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimRight(syscall.UTF16ToString(buf), "\x00"), true
+}
+
+// COM interfaces we need out of the SetupConfiguration API. GUIDs taken
+// from Microsoft.VisualStudio.Setup.Configuration.Native.idl.
+const (
+	clsidSetupConfiguration = "{177F0C4A-1CD3-4DE7-A32C-71DBBB9FA36D}"
+	iidSetupConfiguration   = "{42843719-DB4C-46C2-8E7C-64F1816EFD5B}"
+	iidSetupInstance        = "{B41463C3-8866-43B5-BC33-2B0676F7F42E}"
+)
+
+type guid struct {
+	Data1 uint32
+	Data2 uint16
+	Data3 uint16
+	Data4 [8]byte
+}
+
+func guidFromString(s string) (*guid, error) {
+	s = strings.Trim(s, "{}")
+	parts := strings.Split(s, "-")
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("malformed GUID %q", s)
+	}
+	var g guid
+	var b [8]byte
+	if _, err := fmt.Sscanf(parts[0], "%08x", &g.Data1); err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Sscanf(parts[1], "%04x", &g.Data2); err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Sscanf(parts[2], "%04x", &g.Data3); err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Sscanf(parts[3]+parts[4], "%02x%02x%02x%02x%02x%02x%02x%02x",
+		&b[0], &b[1], &b[2], &b[3], &b[4], &b[5], &b[6], &b[7]); err != nil {
+		return nil, err
+	}
+	g.Data4 = b
+	return &g, nil
+}
+
+var (
+	ole32             = syscall.NewLazyDLL("ole32.dll")
+	procCoInitialize  = ole32.NewProc("CoInitialize")
+	procCoUninit      = ole32.NewProc("CoUninitialize")
+	procCoCreateInst  = ole32.NewProc("CoCreateInstance")
+	procSysFreeString = syscall.NewLazyDLL("oleaut32.dll").NewProc("SysFreeString")
+)
+
+// iunknownVtbl mirrors the start of every COM vtable: QueryInterface,
+// AddRef, Release. We only ever call methods past this prefix via
+// their known offsets, matching how minimal hand-rolled COM clients
+// are written in Go without a full IDL-generated binding.
+type comObject struct {
+	vtbl *uintptr
+}
+
+func (o *comObject) call(vtblIndex uintptr, args ...uintptr) (uintptr, error) {
+	fn := *(*uintptr)(unsafe.Pointer(uintptr(unsafe.Pointer(o.vtbl)) + vtblIndex*unsafe.Sizeof(uintptr(0))))
+	allArgs := append([]uintptr{uintptr(unsafe.Pointer(o))}, args...)
+	r1, _, _ := syscall.SyscallN(fn, allArgs...)
+	if int32(r1) < 0 {
+		return r1, fmt.Errorf("COM call failed, hresult=0x%x", uint32(r1))
+	}
+	return r1, nil
+}
+
+// findVSInstallsViaCOM instantiates the SetupConfiguration COM object
+// (available once the VS 2017+ installer has run) and enumerates every
+// registered instance, returning those with the VC.Tools workload.
+func findVSInstallsViaCOM() (res []VSInstall) {
+	defer func() {
+		// the hand-rolled vtable walk below is only as safe as the
+		// GUIDs and offsets we hard-coded; don't take down the whole
+		// build if a future VS setup API shape doesn't match.
+		if r := recover(); r != nil {
+			fmt.Printf("findVSInstallsViaCOM: recovered from %v\n", r)
+			res = nil
+		}
+	}()
+
+	procCoInitialize.Call(0)
+	defer procCoUninit.Call()
+
+	clsid, err := guidFromString(clsidSetupConfiguration)
+	if err != nil {
+		return nil
+	}
+	iid, err := guidFromString(iidSetupConfiguration)
+	if err != nil {
+		return nil
+	}
+
+	var unk uintptr
+	const clsctxInprocServer = 1
+	hr, _, _ := procCoCreateInst.Call(
+		uintptr(unsafe.Pointer(clsid)),
+		0,
+		clsctxInprocServer,
+		uintptr(unsafe.Pointer(iid)),
+		uintptr(unsafe.Pointer(&unk)),
+	)
+	if int32(hr) < 0 || unk == 0 {
+		// SetupConfiguration not registered: no VS 2017+ on this box.
+		return nil
+	}
+	config := &comObject{vtbl: *(**uintptr)(unsafe.Pointer(unk))}
+	defer config.call(2) // Release
+
+	// ISetupConfiguration::EnumInstances is vtbl slot 3 (after
+	// QueryInterface/AddRef/Release).
+	var enumUnk uintptr
+	if _, err := config.call(3, uintptr(unsafe.Pointer(&enumUnk))); err != nil {
+		return nil
+	}
+	enum := &comObject{vtbl: *(**uintptr)(unsafe.Pointer(enumUnk))}
+	defer enum.call(2)
+
+	for {
+		var instUnk uintptr
+		var fetched uint32
+		// IEnumSetupInstances::Next is vtbl slot 3.
+		_, err := enum.call(3, 1, uintptr(unsafe.Pointer(&instUnk)), uintptr(unsafe.Pointer(&fetched)))
+		if err != nil || fetched == 0 || instUnk == 0 {
+			break
+		}
+		inst := &comObject{vtbl: *(**uintptr)(unsafe.Pointer(instUnk))}
+		if vi, ok := vsInstallFromSetupInstance(inst); ok {
+			res = append(res, vi)
+		}
+		inst.call(2)
+	}
+	return res
+}
+
+// vsInstallFromSetupInstance reads InstallationPath/InstallationVersion
+// off an ISetupInstance (IID_ISetupInstance, iidSetupInstance above) and
+// checks for the VC.Tools package.
+func vsInstallFromSetupInstance(inst *comObject) (VSInstall, bool) {
+	var pathBstr, verBstr uintptr
+	// ISetupInstance vtbl layout after QueryInterface/AddRef/Release (0-2):
+	// 3 GetInstanceId, 4 GetInstallDate, 5 GetInstallationName,
+	// 6 GetInstallationPath, 7 GetInstallationVersion.
+	if _, err := inst.call(6, uintptr(unsafe.Pointer(&pathBstr))); err != nil {
+		return VSInstall{}, false
+	}
+	defer procSysFreeString.Call(pathBstr)
+	if _, err := inst.call(7, uintptr(unsafe.Pointer(&verBstr))); err != nil {
+		return VSInstall{}, false
+	}
+	defer procSysFreeString.Call(verBstr)
+
+	dir := bstrToString(pathBstr)
+	version := bstrToString(verBstr)
+	if dir == "" || version == "" {
+		return VSInstall{}, false
+	}
+	vcToolsDir := findVCToolsDirUnder(dir)
+	if vcToolsDir == "" {
+		// no Microsoft.VisualStudio.Component.VC.Tools.x86.x64 package
+		return VSInstall{}, false
+	}
+	return VSInstall{Version: version, InstallDir: dir, VCToolsDir: vcToolsDir}, true
+}
+
+func bstrToString(bstr uintptr) string {
+	if bstr == 0 {
+		return ""
+	}
+	// a BSTR is a length-prefixed, null-terminated UTF-16 string; the
+	// length prefix lives 4 bytes before the pointer we were handed.
+	length := *(*uint32)(unsafe.Pointer(bstr - 4))
+	chars := length / 2
+	slice := unsafe.Slice((*uint16)(unsafe.Pointer(bstr)), chars)
+	return syscall.UTF16ToString(slice)
+}
+
+// findVCToolsDirUnder looks for the highest-versioned
+// VC\Tools\MSVC\<version> directory under a VS 2017+ install, which is
+// only present when the VC.Tools.x86.x64 component was selected.
+func findVCToolsDirUnder(installDir string) string {
+	msvcDir := pj(installDir, "VC", "Tools", "MSVC")
+	entries, err := os.ReadDir(msvcDir)
+	if err != nil || len(entries) == 0 {
+		return ""
+	}
+	var versions []string
+	for _, e := range entries {
+		if e.IsDir() {
+			versions = append(versions, e.Name())
+		}
+	}
+	if len(versions) == 0 {
+		return ""
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versionLess(versions[i], versions[j])
+	})
+	return pj(msvcDir, versions[len(versions)-1])
+}
+
+// findVSInstallsViaVswhere shells out to vswhere.exe as a last resort,
+// for machines where our hand-rolled COM walk above doesn't line up
+// with the installed setup API.
+func findVSInstallsViaVswhere() []VSInstall {
+	vswhere, err := exec.LookPath("vswhere.exe")
+	if err != nil {
+		// also check the well-known location next to the installer
+		vswhere = pj(os.Getenv("ProgramFiles(x86)"), "Microsoft Visual Studio", "Installer", "vswhere.exe")
+		if !fileExists(vswhere) {
+			return nil
+		}
+	}
+	cmd := exec.Command(vswhere, "-latest", "-products", "*",
+		"-requires", "Microsoft.VisualStudio.Component.VC.Tools.x86.x64",
+		"-property", "installationPath")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil
+	}
+	dir := strings.TrimSpace(string(out))
+	if dir == "" {
+		return nil
+	}
+	vcToolsDir := findVCToolsDirUnder(dir)
+	if vcToolsDir == "" {
+		return nil
+	}
+	return []VSInstall{{Version: "vswhere", InstallDir: dir, VCToolsDir: vcToolsDir}}
+}
+
+// findVSInstalls returns every VS install we could discover, across all
+// three discovery mechanisms, highest version first.
+func findVSInstalls() []VSInstall {
+	var all []VSInstall
+	all = append(all, findVSInstallsLegacy()...)
+	all = append(all, findVSInstallsViaCOM()...)
+	if len(all) == 0 {
+		all = append(all, findVSInstallsViaVswhere()...)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return versionLess(all[j].Version, all[i].Version)
+	})
+	return all
+}
+
+// versionLess compares two dotted version strings ("12.0" < "14.0" <
+// "16.11.31829.152") numerically, component by component.
+func versionLess(a, b string) bool {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		var an, bn int
+		fmt.Sscanf(as[i], "%d", &an)
+		fmt.Sscanf(bs[i], "%d", &bn)
+		if an != bn {
+			return an < bn
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// pickVSInstall picks the VS install to build with: if -vs-version
+// pins a major version (e.g. "14", "16"), the first install whose
+// Version starts with that is used; otherwise the highest version
+// found wins.
+func pickVSInstall() *VSInstall {
+	installs := findVSInstalls()
+	if len(installs) == 0 {
+		return nil
+	}
+	if vsVersionFlag == "" {
+		return &installs[0]
+	}
+	for i := range installs {
+		if strings.HasPrefix(installs[i].Version, vsVersionFlag) {
+			return &installs[i]
+		}
+	}
+	return nil
+}
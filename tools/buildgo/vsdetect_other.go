@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// VSInstall mirrors the Windows type of the same name so main.go/link.go
+// build cross-platform; this tool only ever runs for real on Windows.
+type VSInstall struct {
+	Version    string
+	InstallDir string
+	VCToolsDir string
+}
+
+// pinned via -vs-version, empty means "pick the highest"; kept here so
+// -vs-version still parses (and is simply ignored) off Windows.
+var vsVersionFlag string
+
+// pickVSInstall always fails off Windows: there is no MSVC to find.
+func pickVSInstall() *VSInstall {
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "testing"
+
+func TestVersionLess(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{"12.0", "14.0", true},
+		{"14.0", "12.0", false},
+		{"14.9.24215", "14.16.27023", true},
+		{"14.16.27023", "14.9.24215", false},
+		{"16.11.31829.152", "16.11.31829.152", false},
+		{"14.0", "14.0.1", true},
+	}
+	for _, c := range cases {
+		if got := versionLess(c.a, c.b); got != c.want {
+			t.Errorf("versionLess(%q, %q) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}